@@ -4,6 +4,7 @@ import "crypto/sha1"
 import "encoding/base64"
 import "fmt"
 import "net/http"
+import "sync"
 import "github.com/abbot/go-http-auth"
 import "golang.org/x/net/context"
 
@@ -13,12 +14,19 @@ type DigestAuth struct {
     Secret                  auth.SecretProvider     // return ha1 for authentication success, return empty string for authentication failed
     ClientCacheSize         int                     // see "go-http-auth" package for more information
     ClientCacheTolerance    int                     // see "go-http-auth" package for more information
+    Limiter                 Limiter                 // optional bruteforce protection, consulted before every authentication attempt
+    TrustedProxies          []string                // remote addresses allowed to set X-Forwarded-For when Limiter keys on client IP
+
+    authenticatorOnce sync.Once
+    authenticator     *auth.DigestAuth
 }
 
 
 type BasicAuth struct {
-    Realm  string              // Authentication realm
-    Secret auth.SecretProvider // return empty string for authentication failed, return non-empty string for success
+    Realm          string              // Authentication realm
+    Secret         auth.SecretProvider // return the stored password hash for user (see BasicAuthSecret), or empty string for authentication failed
+    Limiter        Limiter             // optional bruteforce protection, consulted before every authentication attempt
+    TrustedProxies []string            // remote addresses allowed to set X-Forwarded-For when Limiter keys on client IP
 }
 
 
@@ -28,6 +36,34 @@ type AuthTitleBody struct {
 }
 
 
+// AuthInfo describes the identity of a successfully authenticated request, passed
+// to the handler functions registered through DigestAuthHandlerCtx and BasicAuthHandlerCtx.
+type AuthInfo struct {
+    Username string     // the authenticated user name
+    Realm    string     // the realm the request was authenticated against
+    Info     *auth.Info // the raw go-http-auth authentication result
+}
+
+
+type contextKey struct {
+    name string
+}
+
+
+// UserContextKey is the key under which DigestAuthHandler, DigestAuthHandlerCtx,
+// BasicAuthHandler and BasicAuthHandlerCtx store the authenticated user name in
+// a request's context. Use UserFromContext to read it back.
+var UserContextKey = &contextKey{"user"}
+
+
+// UserFromContext returns the user name stashed by DigestAuthHandler(Ctx) or
+// BasicAuthHandler(Ctx) in ctx, if any.
+func UserFromContext(ctx context.Context) (string, bool) {
+    user, ok := ctx.Value(UserContextKey).(string)
+    return user, ok
+}
+
+
 type AuthFile struct {
     ContentType string  // content type of 401 file
     Body []byte         // content of 401 file
@@ -140,44 +176,127 @@ Example:
         http.ListenAndServe(":8000", auth.DigestAuthHandler(serve, errmsg, failfunc))
     }
 */
+// newAuthenticator lazily builds and caches the underlying *auth.DigestAuth, so
+// every call site (authHandler, Authenticate, DigestAuthWrap) shares the same
+// nonce cache and Opaque value. auth.NewDigestAuthenticator picks a fresh random
+// Opaque and an empty nonce cache each time it's called, and CheckAuth rejects a
+// request whose Opaque doesn't match, so building a new one per request would
+// reject every client response.
+func (a *DigestAuth) newAuthenticator() *auth.DigestAuth {
+    a.authenticatorOnce.Do(func() {
+        authenticator := auth.NewDigestAuthenticator(a.Realm, a.Secret)
+        if a.ClientCacheSize > 0 {
+            authenticator.ClientCacheSize = a.ClientCacheSize
+        }
+        if a.ClientCacheTolerance > 0 {
+            authenticator.ClientCacheTolerance = a.ClientCacheTolerance
+        }
+        a.authenticator = authenticator
+    })
+    return a.authenticator
+}
+
+
 func (a *DigestAuth) DigestAuthHandler(handler http.HandlerFunc, failMsg interface{}, failFunc func()) http.HandlerFunc {
-    authenticator := auth.NewDigestAuthenticator(a.Realm, a.Secret)
-    if a.ClientCacheSize > 0 {
-        authenticator.ClientCacheSize = a.ClientCacheSize
-    }
-    if a.ClientCacheTolerance > 0 {
-        authenticator.ClientCacheTolerance = a.ClientCacheTolerance
-    }
+    return a.authHandler(func(w http.ResponseWriter, r *http.Request, info *AuthInfo) {
+        handler(w, r)
+    }, failMsg, failFunc)
+}
+
+
+// DigestAuthHandlerCtx behaves like DigestAuthHandler, but calls handler with the
+// AuthInfo of the authenticated request instead of discarding it, and stashes the
+// user name in the request's context under UserContextKey.
+func (a *DigestAuth) DigestAuthHandlerCtx(handler func(w http.ResponseWriter, r *http.Request, info *AuthInfo), failMsg interface{}, failFunc func()) http.HandlerFunc {
+    return a.authHandler(handler, failMsg, failFunc)
+}
+
+
+func (a *DigestAuth) authHandler(handler func(w http.ResponseWriter, r *http.Request, info *AuthInfo), failMsg interface{}, failFunc func()) http.HandlerFunc {
+    authenticator := a.newAuthenticator()
 
     errHandler := ErrorHandler401(failMsg)
 
     return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        var key string
+        if a.Limiter != nil {
+            key = clientKey(r, a.TrustedProxies)
+            if !a.Limiter.Allow(key) {
+                writeTooManyRequests(w, a.Limiter, key)
+                return
+            }
+        }
+
         ctx := authenticator.NewContext(context.Background(), r)
 
         authInfo := auth.FromContext(ctx)
         authInfo.UpdateHeaders(w.Header())
         if authInfo == nil || !authInfo.Authenticated {
+            if a.Limiter != nil {
+                a.Limiter.Record(key, false)
+            }
             if failFunc != nil {
                 failFunc()
             }
             errHandler(w)
             return
         }
-        handler(w, r)
+
+        if a.Limiter != nil {
+            a.Limiter.Record(key, true)
+        }
+
+        r = r.WithContext(context.WithValue(r.Context(), UserContextKey, authInfo.Username))
+        handler(w, r, &AuthInfo{Username: authInfo.Username, Realm: a.Realm, Info: authInfo})
     })
 }
 
 
-// DigestAuthHandler wrap a http handler function with digest authentication.
-func (a *DigestAuth) DigestAuthWrap(handler http.HandlerFunc) http.HandlerFunc {
-    authenticator := auth.NewDigestAuthenticator(a.Realm, a.Secret)
-    if a.ClientCacheSize > 0 {
-        authenticator.ClientCacheSize = a.ClientCacheSize
+// Authenticate implements Authenticator. It returns the authenticated user name
+// and true on success, or "" and false if r carries no valid digest credentials.
+// On failure it also sets go-http-auth's WWW-Authenticate challenge header, whose
+// nonce and opaque the authenticator tracks (unlike the one Challenge writes).
+// If a.Limiter denies the request it writes a 429 response to w itself instead.
+func (a *DigestAuth) Authenticate(w http.ResponseWriter, r *http.Request) (string, bool) {
+    var key string
+    if a.Limiter != nil {
+        key = clientKey(r, a.TrustedProxies)
+        if !a.Limiter.Allow(key) {
+            writeTooManyRequests(w, a.Limiter, key)
+            return "", false
+        }
+    }
+
+    ctx := a.newAuthenticator().NewContext(context.Background(), r)
+
+    authInfo := auth.FromContext(ctx)
+    authInfo.UpdateHeaders(w.Header())
+    if authInfo == nil || !authInfo.Authenticated {
+        if a.Limiter != nil {
+            a.Limiter.Record(key, false)
+        }
+        return "", false
     }
-    if a.ClientCacheTolerance > 0 {
-        authenticator.ClientCacheTolerance = a.ClientCacheTolerance
+
+    if a.Limiter != nil {
+        a.Limiter.Record(key, true)
     }
-    return authenticator.JustCheck(handler)
+
+    return authInfo.Username, true
+}
+
+
+// Challenge implements Authenticator, writing a fresh WWW-Authenticate: Digest
+// header to w.
+func (a *DigestAuth) Challenge(w http.ResponseWriter) {
+    nonce := generateCnonce()
+    w.Header().Add("WWW-Authenticate", fmt.Sprintf(`Digest realm="%s", qop="auth", nonce="%s"`, a.Realm, nonce))
+}
+
+
+// DigestAuthWrap wraps a http handler function with digest authentication.
+func (a *DigestAuth) DigestAuthWrap(handler http.HandlerFunc) http.HandlerFunc {
+    return a.newAuthenticator().JustCheck(handler)
 }
 
 
@@ -195,23 +314,95 @@ func BasicAuthSecret(username, password string) func (string, string) string {
 
 
 func (a *BasicAuth) BasicAuthHandler(handler http.HandlerFunc, failMsg interface{}, failFunc func()) http.HandlerFunc {
+    return a.authHandler(func(w http.ResponseWriter, r *http.Request, info *AuthInfo) {
+        handler(w, r)
+    }, failMsg, failFunc)
+}
+
+
+// BasicAuthHandlerCtx behaves like BasicAuthHandler, but calls handler with the
+// AuthInfo of the authenticated request instead of discarding it, and stashes the
+// user name in the request's context under UserContextKey.
+func (a *BasicAuth) BasicAuthHandlerCtx(handler func(w http.ResponseWriter, r *http.Request, info *AuthInfo), failMsg interface{}, failFunc func()) http.HandlerFunc {
+    return a.authHandler(handler, failMsg, failFunc)
+}
+
+
+func (a *BasicAuth) authHandler(handler func(w http.ResponseWriter, r *http.Request, info *AuthInfo), failMsg interface{}, failFunc func()) http.HandlerFunc {
     authenticator := auth.NewBasicAuthenticator(a.Realm, a.Secret)
 
     errHandler := ErrorHandler401(failMsg)
 
     return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        var key string
+        if a.Limiter != nil {
+            key = clientKey(r, a.TrustedProxies)
+            if !a.Limiter.Allow(key) {
+                writeTooManyRequests(w, a.Limiter, key)
+                return
+            }
+        }
+
         ctx := authenticator.NewContext(context.Background(), r)
 
         authInfo := auth.FromContext(ctx)
         authInfo.UpdateHeaders(w.Header())
         if authInfo == nil || !authInfo.Authenticated {
+            if a.Limiter != nil {
+                a.Limiter.Record(key, false)
+            }
             if failFunc != nil {
                 failFunc()
             }
             errHandler(w)
             return
         }
-        handler(w, r)
+
+        if a.Limiter != nil {
+            a.Limiter.Record(key, true)
+        }
+
+        r = r.WithContext(context.WithValue(r.Context(), UserContextKey, authInfo.Username))
+        handler(w, r, &AuthInfo{Username: authInfo.Username, Realm: a.Realm, Info: authInfo})
     })
 }
 
+
+// Authenticate implements Authenticator. It returns the authenticated user name
+// and true on success, or "" and false if r carries no valid basic credentials.
+// If a.Limiter denies the request it writes a 429 response to w itself instead.
+func (a *BasicAuth) Authenticate(w http.ResponseWriter, r *http.Request) (string, bool) {
+    var key string
+    if a.Limiter != nil {
+        key = clientKey(r, a.TrustedProxies)
+        if !a.Limiter.Allow(key) {
+            writeTooManyRequests(w, a.Limiter, key)
+            return "", false
+        }
+    }
+
+    ctx := auth.NewBasicAuthenticator(a.Realm, a.Secret).NewContext(context.Background(), r)
+
+    authInfo := auth.FromContext(ctx)
+    authInfo.UpdateHeaders(w.Header())
+    if authInfo == nil || !authInfo.Authenticated {
+        if a.Limiter != nil {
+            a.Limiter.Record(key, false)
+        }
+        return "", false
+    }
+
+    if a.Limiter != nil {
+        a.Limiter.Record(key, true)
+    }
+
+    return authInfo.Username, true
+}
+
+
+// Challenge implements Authenticator, writing a fresh WWW-Authenticate: Basic
+// header to w.
+func (a *BasicAuth) Challenge(w http.ResponseWriter) {
+    w.Header().Add("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s"`, a.Realm))
+}
+
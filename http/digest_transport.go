@@ -0,0 +1,299 @@
+package http
+
+import "crypto/md5"
+import "crypto/rand"
+import "crypto/sha256"
+import "encoding/hex"
+import "fmt"
+import "net/http"
+import "strings"
+import "sync"
+import "time"
+
+
+// DigestTransport is a http.RoundTripper that transparently answers RFC 7616
+// digest challenges, the client-side counterpart of DigestAuthHandler. Wrap it
+// around an existing transport (or leave Transport nil to use
+// http.DefaultTransport) and use it like any other http.RoundTripper.
+type DigestTransport struct {
+    Username  string
+    Password  string
+    Transport http.RoundTripper // underlying transport, defaults to http.DefaultTransport
+
+    mu     sync.Mutex
+    states map[string]*digestState // per-host challenge state, so the nonce/nc can be reused
+}
+
+
+// digestState caches everything needed to build an Authorization header for
+// subsequent requests to the same host without another round trip.
+type digestState struct {
+    realm     string
+    nonce     string
+    opaque    string
+    qop       string
+    algorithm string
+    nc        uint32
+}
+
+
+// NewDigestClient returns a *http.Client that authenticates as username/password
+// against digest-protected endpoints, using http.DefaultTransport underneath.
+func NewDigestClient(username, password string) *http.Client {
+    return &http.Client{
+        Transport: &DigestTransport{Username: username, Password: password},
+    }
+}
+
+
+func (t *DigestTransport) transport() http.RoundTripper {
+    if t.Transport != nil {
+        return t.Transport
+    }
+    return http.DefaultTransport
+}
+
+
+func (t *DigestTransport) getState(host string) *digestState {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    return t.states[host]
+}
+
+
+func (t *DigestTransport) setState(host string, state *digestState) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    if t.states == nil {
+        t.states = make(map[string]*digestState)
+    }
+    t.states[host] = state
+}
+
+
+// RoundTrip implements http.RoundTripper.
+func (t *DigestTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+    transport := t.transport()
+    host := req.URL.Host
+
+    if state := t.getState(host); state != nil {
+        authReq, err := cloneRequest(req)
+        if err != nil {
+            return nil, err
+        }
+        authReq.Header.Set("Authorization", t.authorize(authReq, state))
+
+        resp, err := transport.RoundTrip(authReq)
+        if err != nil || resp.StatusCode != http.StatusUnauthorized {
+            return resp, err
+        }
+
+        challenge := parseDigestChallenge(resp.Header.Get("WWW-Authenticate"))
+        if challenge == nil || !challenge.stale {
+            // Either there's no digest challenge to recover from, or the
+            // server rejected the credentials themselves (not just an
+            // expired nonce) - retrying would fail the same way again.
+            return resp, nil
+        }
+        resp.Body.Close()
+
+        state = newDigestState(challenge)
+        t.setState(host, state)
+
+        authReq, err = cloneRequest(req)
+        if err != nil {
+            return nil, err
+        }
+        authReq.Header.Set("Authorization", t.authorize(authReq, state))
+
+        return transport.RoundTrip(authReq)
+    }
+
+    resp, err := transport.RoundTrip(req)
+    if err != nil || resp.StatusCode != http.StatusUnauthorized {
+        return resp, err
+    }
+
+    challenge := parseDigestChallenge(resp.Header.Get("WWW-Authenticate"))
+    if challenge == nil {
+        return resp, nil
+    }
+    resp.Body.Close()
+
+    state := newDigestState(challenge)
+    t.setState(host, state)
+
+    authReq, err := cloneRequest(req)
+    if err != nil {
+        return nil, err
+    }
+    authReq.Header.Set("Authorization", t.authorize(authReq, state))
+
+    return transport.RoundTrip(authReq)
+}
+
+
+func newDigestState(c *digestChallenge) *digestState {
+    return &digestState{
+        realm:     c.realm,
+        nonce:     c.nonce,
+        opaque:    c.opaque,
+        qop:       c.qop,
+        algorithm: c.algorithm,
+    }
+}
+
+
+// cloneRequest copies req so it can be retried, re-materializing the body from
+// GetBody when present. When it does so, req.Body is left unread - since
+// http.RoundTripper must always close the body it was given, cloneRequest
+// closes it here rather than leaving that to a caller who will never see it
+// again.
+func cloneRequest(req *http.Request) (*http.Request, error) {
+    clone := new(http.Request)
+    *clone = *req
+
+    clone.Header = make(http.Header, len(req.Header))
+    for k, v := range req.Header {
+        clone.Header[k] = append([]string(nil), v...)
+    }
+
+    if req.Body != nil && req.GetBody != nil {
+        body, err := req.GetBody()
+        if err != nil {
+            req.Body.Close()
+            return nil, err
+        }
+        clone.Body = body
+        req.Body.Close()
+    }
+
+    return clone, nil
+}
+
+
+// authorize builds the value of the Authorization header for req against state,
+// incrementing the per-host nonce counter.
+func (t *DigestTransport) authorize(req *http.Request, state *digestState) string {
+    t.mu.Lock()
+    state.nc++
+    nc := state.nc
+    t.mu.Unlock()
+
+    ncStr := fmt.Sprintf("%08x", nc)
+    cnonce := generateCnonce()
+
+    ha1 := hashDigest(state.algorithm, t.Username+":"+state.realm+":"+t.Password)
+    ha2 := hashDigest(state.algorithm, req.Method+":"+req.URL.RequestURI())
+
+    qop := pickQop(state.qop)
+
+    var response string
+    if qop != "" {
+        response = hashDigest(state.algorithm, strings.Join([]string{ha1, state.nonce, ncStr, cnonce, qop, ha2}, ":"))
+    } else {
+        response = hashDigest(state.algorithm, strings.Join([]string{ha1, state.nonce, ha2}, ":"))
+    }
+
+    parts := []string{
+        fmt.Sprintf(`username="%s"`, t.Username),
+        fmt.Sprintf(`realm="%s"`, state.realm),
+        fmt.Sprintf(`nonce="%s"`, state.nonce),
+        fmt.Sprintf(`uri="%s"`, req.URL.RequestURI()),
+        fmt.Sprintf(`response="%s"`, response),
+    }
+    if state.opaque != "" {
+        parts = append(parts, fmt.Sprintf(`opaque="%s"`, state.opaque))
+    }
+    if state.algorithm != "" {
+        parts = append(parts, fmt.Sprintf(`algorithm=%s`, state.algorithm))
+    }
+    if qop != "" {
+        parts = append(parts, fmt.Sprintf(`qop=%s`, qop), fmt.Sprintf(`nc=%s`, ncStr), fmt.Sprintf(`cnonce="%s"`, cnonce))
+    }
+
+    return "Digest " + strings.Join(parts, ", ")
+}
+
+
+// hashDigest hashes data with the algorithm named by the challenge, defaulting
+// to MD5 (algorithm="" means MD5 per RFC 7616) and supporting SHA-256.
+func hashDigest(algorithm, data string) string {
+    if strings.HasPrefix(strings.ToUpper(algorithm), "SHA-256") {
+        sum := sha256.Sum256([]byte(data))
+        return hex.EncodeToString(sum[:])
+    }
+    sum := md5.Sum([]byte(data))
+    return hex.EncodeToString(sum[:])
+}
+
+
+// pickQop prefers "auth" out of a comma separated qop-options list, falling
+// back to whatever the server offered first. auth-int is not supported:
+// authorize never hashes the request body into HA2.
+func pickQop(qop string) string {
+    if qop == "" {
+        return ""
+    }
+    options := strings.Split(qop, ",")
+    for _, o := range options {
+        if strings.TrimSpace(o) == "auth" {
+            return "auth"
+        }
+    }
+    return strings.TrimSpace(options[0])
+}
+
+
+func generateCnonce() string {
+    b := make([]byte, 8)
+    if _, err := rand.Read(b); err != nil {
+        return fmt.Sprintf("%x", time.Now().UnixNano())
+    }
+    return hex.EncodeToString(b)
+}
+
+
+// digestChallenge holds the parsed fields of a WWW-Authenticate: Digest header.
+type digestChallenge struct {
+    realm     string
+    nonce     string
+    qop       string
+    algorithm string
+    opaque    string
+    stale     bool
+}
+
+
+func parseDigestChallenge(header string) *digestChallenge {
+    if !strings.HasPrefix(header, "Digest ") {
+        return nil
+    }
+
+    params := parseAuthParams(header[len("Digest "):])
+    if params["nonce"] == "" {
+        return nil
+    }
+
+    return &digestChallenge{
+        realm:     params["realm"],
+        nonce:     params["nonce"],
+        qop:       params["qop"],
+        algorithm: params["algorithm"],
+        opaque:    params["opaque"],
+        stale:     strings.EqualFold(params["stale"], "true"),
+    }
+}
+
+
+func parseAuthParams(s string) map[string]string {
+    params := make(map[string]string)
+    for _, field := range strings.Split(s, ",") {
+        kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+        if len(kv) != 2 {
+            continue
+        }
+        params[kv[0]] = strings.Trim(kv[1], `"`)
+    }
+    return params
+}
@@ -0,0 +1,177 @@
+package http
+
+import "bufio"
+import "crypto/md5"
+import "crypto/sha1"
+import "encoding/base64"
+import "encoding/hex"
+import "os"
+import "strings"
+import "sync"
+
+import "github.com/abbot/go-http-auth"
+
+
+// HtpasswdFile loads an Apache-style htpasswd file and turns it into
+// auth.SecretProvider values suitable for BasicAuth.Secret and DigestAuth.Secret.
+// The file is re-read whenever its mtime changes, so credentials can be rotated
+// by editing the file in place without restarting the process.
+type HtpasswdFile struct {
+    path string
+
+    mu      sync.RWMutex
+    users   map[string]string // username -> stored secret, format depends on hash prefix
+    modTime int64             // Unix nano of the last loaded mtime
+}
+
+
+// NewHtpasswdFile reads path and returns a HtpasswdFile watching it for changes.
+func NewHtpasswdFile(path string) (*HtpasswdFile, error) {
+    h := &HtpasswdFile{path: path}
+    if err := h.reload(); err != nil {
+        return nil, err
+    }
+    return h, nil
+}
+
+
+// reload re-parses the htpasswd file unconditionally.
+func (h *HtpasswdFile) reload() error {
+    info, err := os.Stat(h.path)
+    if err != nil {
+        return err
+    }
+
+    users, err := parseHtpasswd(h.path)
+    if err != nil {
+        return err
+    }
+
+    h.mu.Lock()
+    h.users = users
+    h.modTime = info.ModTime().UnixNano()
+    h.mu.Unlock()
+
+    return nil
+}
+
+
+// refresh reloads the file if its mtime changed since the last load. Errors are
+// swallowed: if the file becomes briefly unreadable (mid-rewrite, permissions),
+// the previously loaded entries keep serving instead of locking everyone out.
+func (h *HtpasswdFile) refresh() {
+    info, err := os.Stat(h.path)
+    if err != nil {
+        return
+    }
+
+    mtime := info.ModTime().UnixNano()
+
+    h.mu.RLock()
+    changed := mtime != h.modTime
+    h.mu.RUnlock()
+
+    if changed {
+        h.reload()
+    }
+}
+
+
+func parseHtpasswd(path string) (map[string]string, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+
+    users := make(map[string]string)
+
+    scanner := bufio.NewScanner(f)
+    for scanner.Scan() {
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+
+        idx := strings.IndexByte(line, ':')
+        if idx < 0 {
+            continue
+        }
+
+        users[line[:idx]] = line[idx+1:]
+    }
+
+    if err := scanner.Err(); err != nil {
+        return nil, err
+    }
+
+    return users, nil
+}
+
+
+func (h *HtpasswdFile) lookup(user string) (string, bool) {
+    h.refresh()
+
+    h.mu.RLock()
+    defer h.mu.RUnlock()
+
+    secret, ok := h.users[user]
+    return secret, ok
+}
+
+
+// isHashedSecret reports whether secret is stored as bcrypt, {SHA} or apr1 MD5
+// crypt, as opposed to plaintext.
+func isHashedSecret(secret string) bool {
+    switch {
+    case strings.HasPrefix(secret, "$2a$"), strings.HasPrefix(secret, "$2b$"), strings.HasPrefix(secret, "$2y$"):
+        return true
+    case strings.HasPrefix(secret, "{SHA}"):
+        return true
+    case strings.HasPrefix(secret, "$apr1$"):
+        return true
+    }
+    return false
+}
+
+
+// BasicSecret returns an auth.SecretProvider that hands back the entry stored
+// for user. go-http-auth's basic authenticator already knows how to verify
+// bcrypt ($2a$/$2b$/$2y$), {SHA} and apr1 MD5 crypt secrets against the
+// password a client presents, so hashed entries are returned verbatim.
+// Plaintext entries (htpasswd's "-p" option) have no "$"-delimited fields, and
+// go-http-auth's default comparator requires that form, so a plaintext entry
+// would never match; instead it is re-encoded here as "{SHA}"+base64(sha1),
+// the same conversion BasicAuthSecret does, so go-http-auth's {SHA} comparator
+// verifies it correctly.
+func (h *HtpasswdFile) BasicSecret() auth.SecretProvider {
+    return func(user, realm string) string {
+        secret, ok := h.lookup(user)
+        if !ok {
+            return ""
+        }
+        if isHashedSecret(secret) {
+            return secret
+        }
+        sum := sha1.Sum([]byte(secret))
+        return "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+    }
+}
+
+
+// DigestSecret returns an auth.SecretProvider producing HA1 = MD5(user:realm:pass)
+// for digest authentication. Digest auth needs the plaintext password to compute
+// HA1, so only plaintext entries can be served this way; bcrypt, {SHA} and apr1
+// MD5 crypt entries are one-way hashes and cause this provider to return "" for
+// that user, which go-http-auth treats as authentication failure.
+func (h *HtpasswdFile) DigestSecret() auth.SecretProvider {
+    return func(user, realm string) string {
+        secret, ok := h.lookup(user)
+        if !ok || isHashedSecret(secret) {
+            return ""
+        }
+
+        sum := md5.Sum([]byte(user + ":" + realm + ":" + secret))
+        return hex.EncodeToString(sum[:])
+    }
+}
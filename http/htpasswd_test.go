@@ -0,0 +1,157 @@
+package http
+
+import "crypto/md5"
+import "crypto/sha1"
+import "encoding/base64"
+import "encoding/hex"
+import "fmt"
+import "io/ioutil"
+import "os"
+import "testing"
+import "time"
+
+import "github.com/abbot/go-http-auth"
+import "golang.org/x/crypto/bcrypt"
+
+
+const testRealm = "test realm"
+
+
+func writeHtpasswd(t *testing.T, content string) string {
+    t.Helper()
+
+    f, err := ioutil.TempFile("", "htpasswd")
+    if err != nil {
+        t.Fatalf("creating temp htpasswd file: %s", err)
+    }
+    defer f.Close()
+
+    if _, err := f.WriteString(content); err != nil {
+        t.Fatalf("writing temp htpasswd file: %s", err)
+    }
+
+    return f.Name()
+}
+
+
+func TestHtpasswdFileBasicSecret(t *testing.T) {
+    bcryptHash, err := bcrypt.GenerateFromPassword([]byte("bcryptpass"), bcrypt.MinCost)
+    if err != nil {
+        t.Fatalf("generating bcrypt fixture: %s", err)
+    }
+
+    shaSum := sha1.Sum([]byte("shapass"))
+    shaHash := "{SHA}" + base64.StdEncoding.EncodeToString(shaSum[:])
+
+    apr1Hash := string(auth.MD5Crypt([]byte("apr1pass"), []byte("salt1234"), []byte("$apr1$")))
+
+    path := writeHtpasswd(t, fmt.Sprintf(
+        "bcryptuser:%s\nshauser:%s\napr1user:%s\nplainuser:plainpass\n",
+        bcryptHash, shaHash, apr1Hash,
+    ))
+    defer os.Remove(path)
+
+    h, err := NewHtpasswdFile(path)
+    if err != nil {
+        t.Fatalf("NewHtpasswdFile: %s", err)
+    }
+
+    secret := h.BasicSecret()
+
+    if got := secret("bcryptuser", testRealm); got != string(bcryptHash) {
+        t.Errorf("bcrypt entry: got %q, want %q", got, bcryptHash)
+    }
+    if err := bcrypt.CompareHashAndPassword([]byte(secret("bcryptuser", testRealm)), []byte("bcryptpass")); err != nil {
+        t.Errorf("bcrypt entry does not verify against its own password: %s", err)
+    }
+
+    if got := secret("shauser", testRealm); got != shaHash {
+        t.Errorf("{SHA} entry: got %q, want %q", got, shaHash)
+    }
+
+    if got := secret("apr1user", testRealm); got != apr1Hash {
+        t.Errorf("apr1 entry: got %q, want %q", got, apr1Hash)
+    }
+
+    plainSum := sha1.Sum([]byte("plainpass"))
+    wantPlain := "{SHA}" + base64.StdEncoding.EncodeToString(plainSum[:])
+    if got := secret("plainuser", testRealm); got != wantPlain {
+        t.Errorf("plaintext entry: got %q, want %q (re-encoded as {SHA} so go-http-auth can verify it)", got, wantPlain)
+    }
+
+    if got := secret("nosuchuser", testRealm); got != "" {
+        t.Errorf("unknown user: got %q, want empty string", got)
+    }
+}
+
+
+func TestHtpasswdFileDigestSecret(t *testing.T) {
+    bcryptHash, err := bcrypt.GenerateFromPassword([]byte("bcryptpass"), bcrypt.MinCost)
+    if err != nil {
+        t.Fatalf("generating bcrypt fixture: %s", err)
+    }
+
+    shaSum := sha1.Sum([]byte("shapass"))
+    shaHash := "{SHA}" + base64.StdEncoding.EncodeToString(shaSum[:])
+
+    apr1Hash := string(auth.MD5Crypt([]byte("apr1pass"), []byte("salt1234"), []byte("$apr1$")))
+
+    path := writeHtpasswd(t, fmt.Sprintf(
+        "bcryptuser:%s\nshauser:%s\napr1user:%s\nplainuser:plainpass\n",
+        bcryptHash, shaHash, apr1Hash,
+    ))
+    defer os.Remove(path)
+
+    h, err := NewHtpasswdFile(path)
+    if err != nil {
+        t.Fatalf("NewHtpasswdFile: %s", err)
+    }
+
+    secret := h.DigestSecret()
+
+    // bcrypt, {SHA} and apr1 are one-way hashes: HA1 cannot be derived from them.
+    for _, user := range []string{"bcryptuser", "shauser", "apr1user"} {
+        if got := secret(user, testRealm); got != "" {
+            t.Errorf("%s: got %q, want empty string (hashed entries can't serve digest auth)", user, got)
+        }
+    }
+
+    sum := md5.Sum([]byte("plainuser:" + testRealm + ":plainpass"))
+    wantHA1 := hex.EncodeToString(sum[:])
+    if got := secret("plainuser", testRealm); got != wantHA1 {
+        t.Errorf("plaintext entry: got %q, want %q", got, wantHA1)
+    }
+
+    if got := secret("nosuchuser", testRealm); got != "" {
+        t.Errorf("unknown user: got %q, want empty string", got)
+    }
+}
+
+
+func TestHtpasswdFileReloadsOnChange(t *testing.T) {
+    path := writeHtpasswd(t, "alice:secret1\n")
+    defer os.Remove(path)
+
+    h, err := NewHtpasswdFile(path)
+    if err != nil {
+        t.Fatalf("NewHtpasswdFile: %s", err)
+    }
+
+    if _, ok := h.lookup("bob"); ok {
+        t.Fatal("bob should not exist yet")
+    }
+
+    // Advance the mtime so refresh() notices the change even on file systems
+    // with coarse mtime resolution.
+    future := time.Now().Add(time.Second)
+    if err := ioutil.WriteFile(path, []byte("alice:secret1\nbob:secret2\n"), 0644); err != nil {
+        t.Fatalf("rewriting htpasswd file: %s", err)
+    }
+    if err := os.Chtimes(path, future, future); err != nil {
+        t.Fatalf("os.Chtimes: %s", err)
+    }
+
+    if _, ok := h.lookup("bob"); !ok {
+        t.Error("bob should exist after the file was rewritten and reloaded")
+    }
+}
@@ -0,0 +1,199 @@
+package http
+
+import "hash/fnv"
+import "net"
+import "net/http"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+
+
+// Limiter is consulted by DigestAuth and BasicAuth before running the
+// configured authenticator, keyed by client identity (see clientKey). It lets
+// callers bolt on bruteforce protection without touching the handler logic.
+type Limiter interface {
+    // Allow reports whether a request for key may proceed. Returning false
+    // makes the handler answer with 429 Too Many Requests instead of
+    // attempting authentication.
+    Allow(key string) bool
+
+    // Record reports the outcome of an authentication attempt for key.
+    Record(key string, success bool)
+}
+
+
+// retryAfterer is an optional extension of Limiter: implementations that can
+// say how long a blocked key should wait are used to set the Retry-After
+// header. NewLeakyBucketLimiter implements it.
+type retryAfterer interface {
+    RetryAfter(key string) time.Duration
+}
+
+
+// writeTooManyRequests answers a request rejected by a Limiter with 429 and,
+// when limiter supports it, a Retry-After header.
+func writeTooManyRequests(w http.ResponseWriter, limiter Limiter, key string) {
+    retryAfter := time.Minute
+    if p, ok := limiter.(retryAfterer); ok {
+        if d := p.RetryAfter(key); d > 0 {
+            retryAfter = d
+        }
+    }
+    w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+    w.WriteHeader(http.StatusTooManyRequests)
+}
+
+
+// clientKey derives the identity a Limiter should key on from r: the remote
+// address, or the first X-Forwarded-For entry when the request came through
+// one of trustedProxies.
+func clientKey(r *http.Request, trustedProxies []string) string {
+    host := r.RemoteAddr
+    if h, _, err := net.SplitHostPort(host); err == nil {
+        host = h
+    }
+
+    if isTrustedProxy(host, trustedProxies) {
+        if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+            return strings.TrimSpace(strings.SplitN(xff, ",", 2)[0])
+        }
+    }
+
+    return host
+}
+
+
+func isTrustedProxy(host string, trustedProxies []string) bool {
+    for _, p := range trustedProxies {
+        if p == host {
+            return true
+        }
+    }
+    return false
+}
+
+
+const limiterShardCount = 32
+
+
+// LeakyBucketLimiter is the default Limiter: it tracks failed attempts per key
+// in a sharded map, locking a key out once it accrues maxFails failures inside
+// window, for lockout. Entries are garbage collected periodically so memory
+// does not grow with the number of distinct keys ever seen.
+type LeakyBucketLimiter struct {
+    maxFails int
+    window   time.Duration
+    lockout  time.Duration
+
+    shards [limiterShardCount]*limiterShard
+}
+
+
+type limiterShard struct {
+    mu      sync.Mutex
+    buckets map[string]*limiterBucket
+}
+
+
+type limiterBucket struct {
+    fails      int
+    windowEnds time.Time
+    lockedTill time.Time
+}
+
+
+// NewLeakyBucketLimiter returns a LeakyBucketLimiter that locks a key out for
+// lockout once it sees maxFails failed attempts within window. It starts a
+// background goroutine that periodically evicts expired entries and runs for
+// the lifetime of the process.
+func NewLeakyBucketLimiter(maxFails int, window time.Duration, lockout time.Duration) *LeakyBucketLimiter {
+    l := &LeakyBucketLimiter{maxFails: maxFails, window: window, lockout: lockout}
+    for i := range l.shards {
+        l.shards[i] = &limiterShard{buckets: make(map[string]*limiterBucket)}
+    }
+    go l.gcLoop()
+    return l
+}
+
+
+func (l *LeakyBucketLimiter) shardFor(key string) *limiterShard {
+    h := fnv.New32a()
+    h.Write([]byte(key))
+    return l.shards[h.Sum32()%limiterShardCount]
+}
+
+
+// Allow implements Limiter.
+func (l *LeakyBucketLimiter) Allow(key string) bool {
+    shard := l.shardFor(key)
+    shard.mu.Lock()
+    defer shard.mu.Unlock()
+
+    b, ok := shard.buckets[key]
+    if !ok {
+        return true
+    }
+    return !time.Now().Before(b.lockedTill)
+}
+
+
+// Record implements Limiter.
+func (l *LeakyBucketLimiter) Record(key string, success bool) {
+    shard := l.shardFor(key)
+    shard.mu.Lock()
+    defer shard.mu.Unlock()
+
+    if success {
+        delete(shard.buckets, key)
+        return
+    }
+
+    now := time.Now()
+    b, ok := shard.buckets[key]
+    if !ok || now.After(b.windowEnds) {
+        b = &limiterBucket{windowEnds: now.Add(l.window)}
+        shard.buckets[key] = b
+    }
+
+    b.fails++
+    if b.fails >= l.maxFails {
+        b.lockedTill = now.Add(l.lockout)
+    }
+}
+
+
+// RetryAfter implements retryAfterer.
+func (l *LeakyBucketLimiter) RetryAfter(key string) time.Duration {
+    shard := l.shardFor(key)
+    shard.mu.Lock()
+    defer shard.mu.Unlock()
+
+    b, ok := shard.buckets[key]
+    if !ok {
+        return 0
+    }
+
+    if d := time.Until(b.lockedTill); d > 0 {
+        return d
+    }
+    return 0
+}
+
+
+func (l *LeakyBucketLimiter) gcLoop() {
+    ticker := time.NewTicker(l.window)
+    defer ticker.Stop()
+
+    for now := range ticker.C {
+        for _, shard := range l.shards {
+            shard.mu.Lock()
+            for key, b := range shard.buckets {
+                if now.After(b.windowEnds) && now.After(b.lockedTill) {
+                    delete(shard.buckets, key)
+                }
+            }
+            shard.mu.Unlock()
+        }
+    }
+}
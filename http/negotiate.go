@@ -0,0 +1,81 @@
+package http
+
+import "net/http"
+import "golang.org/x/net/context"
+
+
+// Authenticator is implemented by BasicAuth and DigestAuth, and is what
+// NegotiateAuth drives to let a single endpoint accept more than one scheme.
+type Authenticator interface {
+    // Authenticate checks r's credentials, returning the authenticated user
+    // name and true on success. On failure it returns "", false and should
+    // have already set its WWW-Authenticate challenge header on w.
+    Authenticate(w http.ResponseWriter, r *http.Request) (string, bool)
+
+    // Challenge writes this authenticator's WWW-Authenticate header to w,
+    // independent of any particular request.
+    Challenge(w http.ResponseWriter)
+}
+
+
+// NegotiateAuth tries each configured Authenticator in order and accepts the
+// first one that succeeds. If none succeed, each Authenticate call has already
+// left its own WWW-Authenticate challenge header on the response, so the client
+// can pick whichever scheme it supports, the way WebDAV clients negotiate
+// between Basic and Digest.
+type NegotiateAuth struct {
+    Authenticators []Authenticator
+}
+
+
+// Handler wraps handler with negotiated authentication, mirroring
+// DigestAuthHandler and BasicAuthHandler. On success, the authenticated user
+// name is stashed in the request's context under UserContextKey, retrievable
+// with UserFromContext.
+func (n *NegotiateAuth) Handler(handler http.HandlerFunc, failMsg interface{}, failFunc func()) http.HandlerFunc {
+    errHandler := ErrorHandler401(failMsg)
+
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        sw := &statusCapturingWriter{ResponseWriter: w}
+
+        for _, a := range n.Authenticators {
+            user, ok := a.Authenticate(sw, r)
+            if sw.wroteHeader {
+                // An Authenticator with a Limiter already wrote a final
+                // response itself (e.g. 429 Too Many Requests). There is
+                // nothing left for us to add.
+                return
+            }
+            if !ok {
+                continue
+            }
+            r = r.WithContext(context.WithValue(r.Context(), UserContextKey, user))
+            handler(w, r)
+            return
+        }
+
+        if failFunc != nil {
+            failFunc()
+        }
+        // Each Authenticate call above already wrote its own WWW-Authenticate
+        // header via UpdateHeaders (real nonce/opaque tracked by go-http-auth);
+        // calling Challenge here too would add a second, bogus header per
+        // authenticator that a client could never actually satisfy.
+        errHandler(w)
+    })
+}
+
+
+// statusCapturingWriter notices whether a response has already been finalized
+// with WriteHeader, so Handler can tell an Authenticator's own early response
+// (from a Limiter) apart from a plain authentication failure.
+type statusCapturingWriter struct {
+    http.ResponseWriter
+    wroteHeader bool
+}
+
+
+func (w *statusCapturingWriter) WriteHeader(status int) {
+    w.wroteHeader = true
+    w.ResponseWriter.WriteHeader(status)
+}